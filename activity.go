@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+// messageTime returns when a message was sent, preferring the IRCv3
+// server-time tag (which we requested via CAP) over our own clock, since
+// our clock can drift from the server's view of things on an unreliable
+// link.
+func messageTime(m irc.Message) time.Time {
+	if m.Tags != nil {
+		if raw, ok := m.Tags["time"]; ok {
+			if t, err := time.Parse(time.RFC3339Nano, raw); err == nil {
+				return t
+			}
+		}
+	}
+	return time.Now()
+}
+
+// probeIfIdle sends our own PING if the link has been idle for longer than
+// conf.PingInterval, rather than waiting for the server to notice. After
+// several ping intervals of continued silence we mark ourselves away, since
+// at that point the connection is likely on its way out.
+func (s *state) probeIfIdle(conf *Config, c *godrop.Client) {
+	if conf.PingInterval <= 0 {
+		return
+	}
+
+	idle := time.Since(s.lastActivityTime)
+
+	if idle > conf.PingInterval*awayAfter && !s.away {
+		if err := c.Raw("AWAY :idle"); err != nil {
+			s.addError("error sending AWAY: %s", err)
+		} else {
+			s.away = true
+		}
+		return
+	}
+
+	if idle > conf.PingInterval && time.Since(s.lastPingSentAt) > conf.PingInterval {
+		if err := c.Raw(fmt.Sprintf("PING :%d", time.Now().Unix())); err != nil {
+			s.addError("error sending idle probe PING: %s", err)
+		}
+		s.lastPingSentAt = time.Now()
+	}
+}
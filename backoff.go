@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// recordConnectionAttempt accounts for a connection attempt we're about to
+// make against our per-hour budget, rolling the window over if it has
+// elapsed.
+func (s *state) recordConnectionAttempt() {
+	now := time.Now()
+	if now.Sub(s.hourWindowStart) >= time.Hour {
+		s.hourWindowStart = now
+		s.connectionsThisHour = 0
+	}
+	s.connectionsThisHour++
+}
+
+// overBudget reports whether we've used up our connection attempts for the
+// current hour window.
+func (s *state) overBudget(maxPerHour int) bool {
+	return s.connectionsThisHour >= maxPerHour
+}
+
+// timeUntilWindowReset is how long until our per-hour budget window rolls
+// over.
+func (s *state) timeUntilWindowReset() time.Duration {
+	d := s.hourWindowStart.Add(time.Hour).Sub(time.Now())
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// recordFailure accounts for a failed connection attempt, bumping our
+// attempt count and scheduling the next retry using exponential backoff
+// with full jitter.
+func (s *state) recordFailure() {
+	s.attempt++
+	s.nextRetryAt = time.Now().Add(s.backoff())
+}
+
+// backoff computes a full-jitter exponential backoff delay: a random
+// duration between 0 and min(backoffCap, backoffBase*2^attempt).
+func (s *state) backoff() time.Duration {
+	d := backoffBase * time.Duration(uint64(1)<<uint(s.attempt))
+	if d <= 0 || d > backoffCap {
+		d = backoffCap
+	}
+	return time.Duration(rand.Float64() * float64(d))
+}
+
+// maybeResetAttempts resets our backoff attempt counter once the current
+// connection has proven stable.
+func (s *state) maybeResetAttempts() {
+	if s.connectedAt.IsZero() {
+		return
+	}
+	if time.Since(s.connectedAt) > stableAfter {
+		s.attempt = 0
+	}
+}
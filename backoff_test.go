@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMaybeResetAttempts(t *testing.T) {
+	tests := []struct {
+		name        string
+		connectedAt time.Time
+		attempt     int
+		wantAttempt int
+	}{
+		{
+			name:        "never connected leaves attempt untouched",
+			connectedAt: time.Time{},
+			attempt:     4,
+			wantAttempt: 4,
+		},
+		{
+			name:        "recently connected leaves attempt untouched",
+			connectedAt: time.Now(),
+			attempt:     4,
+			wantAttempt: 4,
+		},
+		{
+			name:        "stable connection resets attempt",
+			connectedAt: time.Now().Add(-2 * stableAfter),
+			attempt:     4,
+			wantAttempt: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &state{connectedAt: test.connectedAt, attempt: test.attempt}
+			s.maybeResetAttempts()
+			if s.attempt != test.wantAttempt {
+				t.Errorf("attempt = %d, wanted %d", s.attempt, test.wantAttempt)
+			}
+		})
+	}
+}
+
+func TestOverBudget(t *testing.T) {
+	s := &state{connectionsThisHour: 3}
+
+	if s.overBudget(4) {
+		t.Errorf("overBudget(4) = true with 3 connections, wanted false")
+	}
+	if !s.overBudget(3) {
+		t.Errorf("overBudget(3) = false with 3 connections, wanted true")
+	}
+}
+
+func TestRecordConnectionAttemptRollsOverWindow(t *testing.T) {
+	s := &state{
+		hourWindowStart:     time.Now().Add(-2 * time.Hour),
+		connectionsThisHour: 10,
+	}
+
+	s.recordConnectionAttempt()
+
+	if s.connectionsThisHour != 1 {
+		t.Errorf("connectionsThisHour = %d after window rollover, wanted 1",
+			s.connectionsThisHour)
+	}
+	if time.Since(s.hourWindowStart) > time.Second {
+		t.Errorf("hourWindowStart was not reset on rollover")
+	}
+}
+
+func TestBackoffStaysWithinBounds(t *testing.T) {
+	s := &state{}
+
+	for attempt := 0; attempt < 20; attempt++ {
+		s.attempt = attempt
+		d := s.backoff()
+		if d < 0 || d > backoffCap {
+			t.Errorf("backoff() at attempt %d = %s, wanted within [0, %s]",
+				attempt, d, backoffCap)
+		}
+	}
+}
+
+func TestRecordFailureSchedulesNextRetry(t *testing.T) {
+	s := &state{}
+
+	before := time.Now()
+	s.recordFailure()
+
+	if s.attempt != 1 {
+		t.Errorf("attempt = %d after one failure, wanted 1", s.attempt)
+	}
+	if s.nextRetryAt.Before(before) {
+		t.Errorf("nextRetryAt = %s, wanted it no earlier than %s", s.nextRetryAt, before)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds what we parsed for a single network from a config file. A
+// config file may define more than one of these, one per [network] section.
+type Config struct {
+	// Name is the section name, e.g. "libera" for a [libera] section. It
+	// identifies the network for logging and for report-network.
+	Name string
+
+	Channels   []string
+	Nick       string
+	ServerHost string
+	ServerPort int
+
+	TLS           bool
+	TLSSkipVerify bool
+	TLSCAFile     string
+	TLSClientCert string
+	TLSClientKey  string
+
+	SASLMechanism string
+	SASLUser      string
+	SASLPass      string
+
+	MaxConnectionsPerHour int
+
+	SinkType string
+
+	SinkFilePath   string
+	SinkMaxSizeMB  int
+	SinkMaxAgeDays int
+	SinkMaxBackups int
+
+	SinkSyslogNetwork string
+	SinkSyslogAddress string
+
+	AutoJoinOnInvite bool
+
+	PingInterval time.Duration
+
+	// ReportNetwork and ReportChannel let this network's errors also be
+	// reported into a channel on another configured network.
+	ReportNetwork string
+	ReportChannel string
+}
+
+// section is one [name] block from the config file, and the key/value
+// pairs under it.
+type section struct {
+	name   string
+	values map[string]string
+}
+
+// parseConfig reads a config file defining one or more networks, each as
+// its own [name] section, and returns a Config per network.
+func parseConfig(path string) ([]*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading file: %s: %s", path, err)
+	}
+
+	sections, err := splitSections(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	if len(sections) == 0 {
+		return nil, fmt.Errorf("%s defines no networks", path)
+	}
+
+	names := map[string]bool{}
+	var configs []*Config
+	for _, sec := range sections {
+		if names[sec.name] {
+			return nil, fmt.Errorf("duplicate network section: %s", sec.name)
+		}
+		names[sec.name] = true
+
+		conf, err := parseNetworkConfig(sec.name, sec.values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", sec.name, err)
+		}
+		configs = append(configs, conf)
+	}
+
+	for _, conf := range configs {
+		if conf.ReportNetwork != "" && !names[conf.ReportNetwork] {
+			return nil, fmt.Errorf("%s: report-network %s is not a configured network",
+				conf.Name, conf.ReportNetwork)
+		}
+	}
+
+	return configs, nil
+}
+
+// splitSections breaks a config file into its [name] sections, each with
+// its own key=value pairs.
+func splitSections(buf []byte) ([]section, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+
+	var sections []section
+	var current *section
+
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+
+		if text[0] == '[' {
+			if text[len(text)-1] != ']' {
+				return nil, fmt.Errorf("malformed section header: %s", text)
+			}
+
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			if name == "" {
+				return nil, fmt.Errorf("section header has no name: %s", text)
+			}
+
+			if current != nil {
+				sections = append(sections, *current)
+			}
+			current = &section{name: name, values: map[string]string{}}
+			continue
+		}
+
+		if current == nil {
+			return nil, fmt.Errorf("key outside of any [network] section: %s", text)
+		}
+
+		pieces := strings.SplitN(text, "=", 2)
+		if len(pieces) != 2 {
+			return nil, fmt.Errorf("malformed line: %s", text)
+		}
+
+		key := strings.TrimSpace(pieces[0])
+		value := strings.TrimSpace(pieces[1])
+
+		if key == "" {
+			return nil, fmt.Errorf("key is blank: %s", text)
+		}
+
+		// Allow value to be blank
+
+		if _, ok := current.values[key]; ok {
+			return nil, fmt.Errorf("duplicate key: %s", key)
+		}
+
+		current.values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning: %s", err)
+	}
+
+	if current != nil {
+		sections = append(sections, *current)
+	}
+
+	return sections, nil
+}
+
+// parseNetworkConfig builds a Config for a single network out of the
+// key/value pairs from its section.
+func parseNetworkConfig(name string, m map[string]string) (*Config, error) {
+	conf := &Config{Name: name}
+
+	channelsRaw := strings.Split(m["channels"], ",")
+	for _, c := range channelsRaw {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if c[0] != '#' {
+			return nil, fmt.Errorf("malformed channel name: %s", c)
+		}
+		// We could look for dupes.
+		conf.Channels = append(conf.Channels, c)
+	}
+	if len(conf.Channels) == 0 {
+		return nil, fmt.Errorf("you must specify at least one channel")
+	}
+
+	if v := m["nick"]; v == "" {
+		return nil, fmt.Errorf("you must specify a nick")
+	}
+	conf.Nick = m["nick"]
+
+	if v := m["server-host"]; v == "" {
+		return nil, fmt.Errorf("you must specify a server-host")
+	}
+	conf.ServerHost = m["server-host"]
+
+	p, err := strconv.ParseInt(m["server-port"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server-port: %s", err)
+	}
+	conf.ServerPort = int(p)
+
+	if v := m["tls"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls: %s", err)
+		}
+		conf.TLS = b
+	}
+
+	if v := m["tls-skip-verify"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls-skip-verify: %s", err)
+		}
+		conf.TLSSkipVerify = b
+	}
+
+	conf.TLSCAFile = m["tls-ca-file"]
+	conf.TLSClientCert = m["tls-client-cert"]
+	conf.TLSClientKey = m["tls-client-key"]
+
+	conf.SASLMechanism = strings.ToUpper(m["sasl-mechanism"])
+	if conf.SASLMechanism != "" && conf.SASLMechanism != "PLAIN" &&
+		conf.SASLMechanism != "EXTERNAL" {
+		return nil, fmt.Errorf("unsupported sasl-mechanism: %s", conf.SASLMechanism)
+	}
+	conf.SASLUser = m["sasl-user"]
+	conf.SASLPass = m["sasl-pass"]
+	if conf.SASLMechanism == "PLAIN" && (conf.SASLUser == "" || conf.SASLPass == "") {
+		return nil, fmt.Errorf("sasl-user and sasl-pass are required for SASL PLAIN")
+	}
+
+	conf.MaxConnectionsPerHour = defaultMaxConnectionsPerHour
+	if v := m["max-connections-per-hour"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max-connections-per-hour: %s", err)
+		}
+		conf.MaxConnectionsPerHour = int(n)
+	}
+
+	conf.SinkType = m["sink-type"]
+	conf.SinkFilePath = m["sink-file-path"]
+
+	if v := m["sink-max-size-mb"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink-max-size-mb: %s", err)
+		}
+		conf.SinkMaxSizeMB = int(n)
+	}
+
+	if v := m["sink-max-age-days"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink-max-age-days: %s", err)
+		}
+		conf.SinkMaxAgeDays = int(n)
+	}
+
+	if v := m["sink-max-backups"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sink-max-backups: %s", err)
+		}
+		conf.SinkMaxBackups = int(n)
+	}
+
+	conf.SinkSyslogNetwork = m["sink-syslog-network"]
+	conf.SinkSyslogAddress = m["sink-syslog-address"]
+
+	switch conf.SinkType {
+	case "", "console":
+	case "file":
+		if conf.SinkFilePath == "" {
+			return nil, fmt.Errorf("sink-file-path is required when sink-type is file")
+		}
+	case "syslog":
+		if conf.SinkSyslogAddress != "" && conf.SinkSyslogNetwork == "" {
+			conf.SinkSyslogNetwork = "udp"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported sink-type: %s", conf.SinkType)
+	}
+
+	if v := m["auto-join-on-invite"]; v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auto-join-on-invite: %s", err)
+		}
+		conf.AutoJoinOnInvite = b
+	}
+
+	conf.PingInterval = defaultPingInterval
+	if v := m["ping-interval"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ping-interval: %s", err)
+		}
+		conf.PingInterval = time.Duration(n) * time.Minute
+	}
+
+	conf.ReportNetwork = m["report-network"]
+	conf.ReportChannel = m["report-channel"]
+	if (conf.ReportNetwork == "") != (conf.ReportChannel == "") {
+		return nil, fmt.Errorf(
+			"report-network and report-channel must be set together")
+	}
+
+	return conf, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import "testing"
+
+func TestSplitSections(t *testing.T) {
+	buf := []byte(`
+# a comment
+[libera]
+nick = bot
+channels = #foo, #bar
+
+[oftc]
+nick = bot2
+channels = #baz
+`)
+
+	sections, err := splitSections(buf)
+	if err != nil {
+		t.Fatalf("splitSections() = %s", err)
+	}
+
+	if len(sections) != 2 {
+		t.Fatalf("len(sections) = %d, wanted 2", len(sections))
+	}
+
+	if sections[0].name != "libera" || sections[0].values["nick"] != "bot" {
+		t.Errorf("sections[0] = %+v, wanted name libera, nick bot", sections[0])
+	}
+	if sections[1].name != "oftc" || sections[1].values["channels"] != "#baz" {
+		t.Errorf("sections[1] = %+v, wanted name oftc, channels #baz", sections[1])
+	}
+}
+
+func TestSplitSectionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  string
+	}{
+		{"key outside section", "nick = bot\n"},
+		{"malformed header", "[libera\nnick = bot\n"},
+		{"empty header", "[]\nnick = bot\n"},
+		{"malformed line", "[libera]\nnick bot\n"},
+		{"blank key", "[libera]\n = bot\n"},
+		{"duplicate key", "[libera]\nnick = bot\nnick = bot2\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := splitSections([]byte(test.buf)); err == nil {
+				t.Errorf("splitSections(%q) = nil error, wanted an error", test.buf)
+			}
+		})
+	}
+}
+
+func TestParseNetworkConfig(t *testing.T) {
+	m := map[string]string{
+		"channels":    "#foo, #bar",
+		"nick":        "bot",
+		"server-host": "irc.example.org",
+		"server-port": "6697",
+	}
+
+	conf, err := parseNetworkConfig("example", m)
+	if err != nil {
+		t.Fatalf("parseNetworkConfig() = %s", err)
+	}
+
+	if conf.Name != "example" {
+		t.Errorf("Name = %s, wanted example", conf.Name)
+	}
+	if len(conf.Channels) != 2 || conf.Channels[0] != "#foo" || conf.Channels[1] != "#bar" {
+		t.Errorf("Channels = %v, wanted [#foo #bar]", conf.Channels)
+	}
+	if conf.ServerPort != 6697 {
+		t.Errorf("ServerPort = %d, wanted 6697", conf.ServerPort)
+	}
+	if conf.MaxConnectionsPerHour != defaultMaxConnectionsPerHour {
+		t.Errorf("MaxConnectionsPerHour = %d, wanted default %d",
+			conf.MaxConnectionsPerHour, defaultMaxConnectionsPerHour)
+	}
+	if conf.PingInterval != defaultPingInterval {
+		t.Errorf("PingInterval = %s, wanted default %s", conf.PingInterval, defaultPingInterval)
+	}
+}
+
+func TestParseNetworkConfigErrors(t *testing.T) {
+	base := map[string]string{
+		"channels":    "#foo",
+		"nick":        "bot",
+		"server-host": "irc.example.org",
+		"server-port": "6697",
+	}
+
+	withOverride := func(key, value string) map[string]string {
+		m := map[string]string{}
+		for k, v := range base {
+			m[k] = v
+		}
+		m[key] = value
+		return m
+	}
+
+	tests := []struct {
+		name string
+		m    map[string]string
+	}{
+		{"no channels", withOverride("channels", "")},
+		{"malformed channel", withOverride("channels", "foo")},
+		{"no nick", withOverride("nick", "")},
+		{"no server-host", withOverride("server-host", "")},
+		{"invalid server-port", withOverride("server-port", "not-a-number")},
+		{"invalid sasl-mechanism", withOverride("sasl-mechanism", "DIGEST-MD5")},
+		{"sasl plain missing creds", withOverride("sasl-mechanism", "PLAIN")},
+		{"invalid sink-type", withOverride("sink-type", "carrier-pigeon")},
+		{"file sink missing path", withOverride("sink-type", "file")},
+		{"report-network without report-channel", withOverride("report-network", "other")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseNetworkConfig("example", test.m); err == nil {
+				t.Errorf("parseNetworkConfig(%+v) = nil error, wanted an error", test.m)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+// errNicknameInUse is the numeric a server sends when the nick we asked for
+// is taken.
+const errNicknameInUse = "433"
+
+// Handler reacts to a single incoming IRC message.
+type Handler func(c *godrop.Client, s *state, m irc.Message) error
+
+// fatalHandlerError marks a Handler error as one that should end the
+// connection immediately, rather than only once we've given up on it
+// being transient.
+type fatalHandlerError struct {
+	err error
+}
+
+func (e *fatalHandlerError) Error() string {
+	return e.err.Error()
+}
+
+func isFatalHandlerError(err error) bool {
+	_, ok := err.(*fatalHandlerError)
+	return ok
+}
+
+// HandlerSet maps IRC commands to the handlers registered for them. "*"
+// matches every command, in addition to any handlers registered for the
+// specific command.
+type HandlerSet struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+func newHandlerSet() *HandlerSet {
+	return &HandlerSet{handlers: map[string][]Handler{}}
+}
+
+// AddHandler registers h to run whenever a message with the given command
+// arrives.
+func (hs *HandlerSet) AddHandler(command string, h Handler) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	command = strings.ToUpper(command)
+	hs.handlers[command] = append(hs.handlers[command], h)
+}
+
+// Dispatch runs every handler registered for m.Command, then every handler
+// registered for "*", returning the errors any of them produced.
+func (hs *HandlerSet) Dispatch(c *godrop.Client, s *state, m irc.Message) []error {
+	hs.mu.RLock()
+	handlers := append([]Handler{}, hs.handlers[strings.ToUpper(m.Command)]...)
+	handlers = append(handlers, hs.handlers["*"]...)
+	hs.mu.RUnlock()
+
+	var errs []error
+	for _, h := range handlers {
+		if err := h(c, s, m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// registerBuiltinHandlers wires up the handlers that make umbled behave
+// like a bot rather than a bare keepalive: answering pings, rejoining if
+// kicked, optionally joining channels we're invited to, and working around
+// nick collisions.
+func registerBuiltinHandlers(hs *HandlerSet, conf *Config) {
+	hs.AddHandler("PING", func(c *godrop.Client, s *state, m irc.Message) error {
+		if err := c.Pong(m); err != nil {
+			return fmt.Errorf("error PONGing: %s", err)
+		}
+		s.lastActivityTime = time.Now()
+		return nil
+	})
+
+	hs.AddHandler("ERROR", func(c *godrop.Client, s *state, m irc.Message) error {
+		return &fatalHandlerError{fmt.Errorf("received ERROR: %s", m)}
+	})
+
+	hs.AddHandler("KICK", func(c *godrop.Client, s *state, m irc.Message) error {
+		if len(m.Params) < 2 || !strings.EqualFold(m.Params[1], s.nick) {
+			return nil
+		}
+
+		if err := c.Join(m.Params[0]); err != nil {
+			return fmt.Errorf("error rejoining %s after kick: %s", m.Params[0], err)
+		}
+		return nil
+	})
+
+	hs.AddHandler("INVITE", func(c *godrop.Client, s *state, m irc.Message) error {
+		if !conf.AutoJoinOnInvite || len(m.Params) < 2 {
+			return nil
+		}
+
+		channel := m.Params[len(m.Params)-1]
+		if err := c.Join(channel); err != nil {
+			return fmt.Errorf("error joining %s after invite: %s", channel, err)
+		}
+		return nil
+	})
+
+	hs.AddHandler(errNicknameInUse, func(c *godrop.Client, s *state, m irc.Message) error {
+		s.nick += "_"
+		if err := c.Raw("NICK " + s.nick); err != nil {
+			return fmt.Errorf("error sending NICK after collision: %s", err)
+		}
+		return nil
+	})
+}
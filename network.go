@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+// readResult is the outcome of a single ReadMessage call made on the
+// background reader goroutine started by startReader.
+type readResult struct {
+	m   irc.Message
+	err error
+}
+
+// startReader issues a single blocking c.ReadMessage() call on its own
+// goroutine and returns a channel that receives its result. Reading this
+// way, instead of calling c.ReadMessage() directly in the main select
+// loop, means a read that's taking a while (because the link is idle, not
+// dead) doesn't stop us from noticing ctx cancellation, a config reload, or
+// our own idle-probe ticker in the meantime.
+func startReader(c *godrop.Client) <-chan readResult {
+	ch := make(chan readResult, 1)
+	go func() {
+		m, err := c.ReadMessage()
+		ch <- readResult{m: m, err: err}
+	}()
+	return ch
+}
+
+// readTimeout derives how long we let the client wait for any data at all
+// before ReadMessage gives up, from conf.PingInterval. It needs enough
+// headroom for our own idle-probe/away cycle (see probeIfIdle) to run its
+// course first, since that's what should notice a dead link in the common
+// case.
+func readTimeout(conf *Config) time.Duration {
+	if conf.PingInterval <= 0 {
+		return 7 * time.Minute
+	}
+	return conf.PingInterval * (awayAfter + 1)
+}
+
+// crossNetworkMessage is a message destined for a channel on a network other
+// than the one that produced it.
+type crossNetworkMessage struct {
+	channel string
+	text    string
+}
+
+// crossNetworkBus lets each network's state report errors into a channel on
+// a different network, e.g. so all of a user's networks can report problems
+// into one admin channel.
+type crossNetworkBus struct {
+	mu    sync.Mutex
+	inbox map[string]chan crossNetworkMessage
+}
+
+// newCrossNetworkBus builds a bus with an inbox for each of the given
+// network names.
+func newCrossNetworkBus(networks []string) *crossNetworkBus {
+	inbox := map[string]chan crossNetworkMessage{}
+	for _, name := range networks {
+		inbox[name] = make(chan crossNetworkMessage, 32)
+	}
+	return &crossNetworkBus{inbox: inbox}
+}
+
+// send delivers text to channel on network, dropping it silently if network
+// isn't known or its inbox is full. We'd rather lose a report than block the
+// network that's sending it.
+func (b *crossNetworkBus) send(network, channel, text string) {
+	b.mu.Lock()
+	ch, ok := b.inbox[network]
+	b.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- crossNetworkMessage{channel: channel, text: text}:
+	default:
+	}
+}
+
+// receive returns the channel a network should read its incoming
+// cross-network reports from.
+func (b *crossNetworkBus) receive(network string) <-chan crossNetworkMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inbox[network]
+}
+
+// busSink is a Sink that forwards warning and error level messages onto
+// another network's channel via the cross-network bus, rather than logging
+// them locally.
+type busSink struct {
+	bus     *crossNetworkBus
+	network string
+	channel string
+}
+
+func (b *busSink) Log(level logLevel, ts time.Time, msg string) {
+	if level < levelWarn {
+		return
+	}
+	b.bus.send(b.network, b.channel, fmt.Sprintf("%s: %s", ts.Format(time.RFC3339), msg))
+}
+
+func (b *busSink) Close() error {
+	return nil
+}
+
+// superviseNetworks runs one network per entry in configs until it's told to
+// stop, either by a SIGINT/SIGTERM or by the context being cancelled. A
+// SIGHUP re-reads path and pushes the new settings out to each running
+// network to apply live.
+func superviseNetworks(path string, configs []*Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var names []string
+	reloadChs := map[string]chan *Config{}
+	for _, conf := range configs {
+		names = append(names, conf.Name)
+		reloadChs[conf.Name] = make(chan *Config, 1)
+	}
+
+	bus := newCrossNetworkBus(names)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	go func() {
+		for sig := range sigs {
+			switch sig {
+			case syscall.SIGHUP:
+				reread(path, reloadChs)
+			case syscall.SIGINT, syscall.SIGTERM:
+				cancel()
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, conf := range configs {
+		wg.Add(1)
+		go func(conf *Config) {
+			defer wg.Done()
+			runNetwork(ctx, conf, bus, reloadChs[conf.Name])
+		}(conf)
+	}
+
+	wg.Wait()
+}
+
+// reread re-parses path and pushes each resulting Config out to the reload
+// channel for the network it belongs to. It logs rather than exits on
+// failure, since a bad reload shouldn't take down networks that are already
+// running.
+func reread(path string, reloadChs map[string]chan *Config) {
+	configs, err := parseConfig(path)
+	if err != nil {
+		log.Printf("error re-reading %s: %s", path, err)
+		return
+	}
+
+	for _, conf := range configs {
+		reloadCh, ok := reloadChs[conf.Name]
+		if !ok {
+			log.Printf("ignoring new network %s found on reload; "+
+				"restart to pick up newly added networks", conf.Name)
+			continue
+		}
+
+		// Drop any stale reload that hasn't been picked up yet in favour of
+		// this newer one.
+		select {
+		case <-reloadCh:
+		default:
+		}
+
+		reloadCh <- conf
+	}
+}
+
+// runNetwork owns the connection to a single network: connecting,
+// reconnecting with backoff, dispatching incoming messages, and relaying
+// queued IRC reports, until ctx is cancelled. It also applies any config
+// reload pushed to reloadCh.
+func runNetwork(ctx context.Context, conf *Config, bus *crossNetworkBus, reloadCh chan *Config) {
+	s, err := newState(conf, bus)
+	if err != nil {
+		log.Printf("%s: %s", conf.Name, err)
+		return
+	}
+
+	c := godrop.New(conf.Nick, conf.Nick, conf.Nick, conf.ServerHost,
+		conf.ServerPort, conf.TLS)
+	c.SetTimeoutTime(readTimeout(conf))
+
+	if conf.TLS {
+		tlsConfig, err := buildTLSConfig(conf)
+		if err != nil {
+			s.addError("error building TLS config: %s", err)
+			return
+		}
+		c.SetTLSConfig(tlsConfig)
+	}
+
+	reports := bus.receive(conf.Name)
+
+	// readCh holds the in-flight background read, if any. We keep it nil
+	// whenever we're not connected, and start a fresh one each time the
+	// previous one resolves, so there's always at most one ReadMessage call
+	// outstanding.
+	var readCh <-chan readResult
+
+	for {
+		if !c.IsConnected() {
+			if readCh != nil {
+				// The background read's ReadMessage call is synchronous on c,
+				// which we're about to reuse for a fresh Connect(). c.Close()
+				// (already called on every path that got us here) unblocks it,
+				// but that doesn't mean it's actually returned yet - wait for it
+				// so we don't race a stale read against the reconnect.
+				<-readCh
+				readCh = nil
+			}
+			// Only a connection that's actually still up can be "stable", so
+			// clear connectedAt as soon as we notice it's gone. Otherwise a
+			// connection that was up at some point keeps maybeResetAttempts
+			// resetting our backoff on every tick, even while we're failing to
+			// reconnect.
+			s.connectedAt = time.Time{}
+		} else if readCh == nil {
+			readCh = startReader(c)
+		}
+
+		select {
+		case <-ctx.Done():
+			if c.IsConnected() {
+				_ = c.Raw("QUIT :shutting down")
+			}
+			_ = c.Close()
+			return
+
+		case newConf := <-reloadCh:
+			applyReload(c, conf, newConf, s)
+			continue
+
+		case report := <-reports:
+			if c.IsConnected() {
+				if err := c.Message(report.channel, report.text); err != nil {
+					s.addError("error relaying cross-network report: %s", err)
+				}
+			}
+			continue
+
+		case res := <-readCh:
+			readCh = nil
+
+			if res.err != nil {
+				s.addError("error reading: %s", res.err)
+				// If we hit EOF then we'll see it from now on, so give up.
+				if s.shouldGiveUp() || res.err == io.EOF {
+					_ = c.Close()
+				}
+				continue
+			}
+
+			m := res.m
+			s.lastActivityTime = messageTime(m)
+
+			if s.away {
+				if err := c.Raw("AWAY"); err != nil {
+					s.addError("error clearing away status: %s", err)
+				} else {
+					s.away = false
+				}
+			}
+
+			for _, handlerErr := range s.handlers.Dispatch(c, s, m) {
+				s.addError("error handling %s: %s", m.Command, handlerErr)
+				if isFatalHandlerError(handlerErr) || s.shouldGiveUp() {
+					_ = c.Close()
+				}
+			}
+
+			if m.Command == "PING" {
+				if err := sendMessages(conf, c, s); err != nil {
+					s.addError("error messaging: %s", err)
+					if s.shouldGiveUp() {
+						_ = c.Close()
+					}
+				}
+			}
+			continue
+
+		case <-time.After(time.Second):
+		}
+
+		s.maybeResetAttempts()
+
+		if !c.IsConnected() {
+			if s.overBudget(conf.MaxConnectionsPerHour) {
+				wait := s.timeUntilWindowReset()
+				s.logf(levelWarn, "hit connection budget of %d/hour, waiting %s",
+					conf.MaxConnectionsPerHour, wait)
+
+				select {
+				case <-ctx.Done():
+					_ = c.Close()
+					return
+				case newConf := <-reloadCh:
+					applyReload(c, conf, newConf, s)
+				case <-time.After(wait):
+					s.hourWindowStart = time.Now()
+					s.connectionsThisHour = 0
+				}
+				continue
+			}
+
+			if time.Now().Before(s.nextRetryAt) {
+				continue
+			}
+
+			s.recordConnectionAttempt()
+
+			if err := connect(conf, c, s); err != nil {
+				s.addError("error connecting: %s", err)
+				_ = c.Close()
+				s.recordFailure()
+				continue
+			}
+
+			s.connectedAt = time.Now()
+			s.lastActivityTime = time.Now()
+			s.lastPingSentAt = time.Now()
+			s.logf(levelInfo, "connected to %s:%d", conf.ServerHost, conf.ServerPort)
+			continue
+		}
+
+		s.probeIfIdle(conf, c)
+	}
+}
+
+// applyReload updates conf in place with newConf's settings, and if we're
+// currently connected, joins/parts channels to match the new channel list
+// without dropping the connection.
+func applyReload(c *godrop.Client, conf, newConf *Config, s *state) {
+	if c.IsConnected() {
+		added, removed := diffChannels(conf.Channels, newConf.Channels)
+
+		for _, ch := range added {
+			if err := c.Join(ch); err != nil {
+				s.addError("error joining %s on reload: %s", ch, err)
+			}
+		}
+
+		for _, ch := range removed {
+			if err := c.Raw("PART " + ch); err != nil {
+				s.addError("error parting %s on reload: %s", ch, err)
+			}
+		}
+	}
+
+	*conf = *newConf
+
+	s.logf(levelInfo, "reloaded config")
+}
+
+// diffChannels reports which channels are in updated but not old (added),
+// and which are in old but not updated (removed).
+func diffChannels(old, updated []string) (added, removed []string) {
+	oldSet := map[string]bool{}
+	for _, ch := range old {
+		oldSet[ch] = true
+	}
+
+	updatedSet := map[string]bool{}
+	for _, ch := range updated {
+		updatedSet[ch] = true
+		if !oldSet[ch] {
+			added = append(added, ch)
+		}
+	}
+
+	for _, ch := range old {
+		if !updatedSet[ch] {
+			removed = append(removed, ch)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffChannels(t *testing.T) {
+	tests := []struct {
+		name                   string
+		old, updated           []string
+		wantAdded, wantRemoved []string
+	}{
+		{
+			name:        "no change",
+			old:         []string{"#a", "#b"},
+			updated:     []string{"#a", "#b"},
+			wantAdded:   nil,
+			wantRemoved: nil,
+		},
+		{
+			name:        "channel added",
+			old:         []string{"#a"},
+			updated:     []string{"#a", "#b"},
+			wantAdded:   []string{"#b"},
+			wantRemoved: nil,
+		},
+		{
+			name:        "channel removed",
+			old:         []string{"#a", "#b"},
+			updated:     []string{"#a"},
+			wantAdded:   nil,
+			wantRemoved: []string{"#b"},
+		},
+		{
+			name:        "channel added and removed",
+			old:         []string{"#a", "#b"},
+			updated:     []string{"#b", "#c"},
+			wantAdded:   []string{"#c"},
+			wantRemoved: []string{"#a"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			added, removed := diffChannels(test.old, test.updated)
+			sort.Strings(added)
+			sort.Strings(removed)
+
+			if !reflect.DeepEqual(added, test.wantAdded) {
+				t.Errorf("added = %v, wanted %v", added, test.wantAdded)
+			}
+			if !reflect.DeepEqual(removed, test.wantRemoved) {
+				t.Errorf("removed = %v, wanted %v", removed, test.wantRemoved)
+			}
+		})
+	}
+}
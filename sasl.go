@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/horgh/godrop"
+	"github.com/horgh/irc"
+)
+
+// saslChunkSize is the maximum length of the base64 payload we put on a
+// single AUTHENTICATE line, per the SASL IRCv3 spec.
+const saslChunkSize = 400
+
+// SASL related numerics. These aren't common enough to show up in most IRC
+// libraries' numeric lists, so we define the ones we need here.
+const (
+	rplSASLSuccess = "903"
+	errSASLFail    = "904"
+	errSASLTooLong = "905"
+	errSASLAborted = "906"
+	errSASLAlready = "907"
+)
+
+// ircv3Caps are the capabilities (besides sasl) we ask for when the server
+// advertises them.
+var ircv3Caps = []string{
+	"server-time",
+	"message-tags",
+	"batch",
+	"account-notify",
+	"away-notify",
+	"chghost",
+}
+
+// saslNegotiation tracks CAP/SASL negotiation state for a single connection
+// attempt. Despite the name it drives all of our CAP negotiation, since
+// requesting sasl happens as part of the same CAP REQ as everything else.
+type saslNegotiation struct {
+	conf *Config
+
+	// lsPending accumulates capabilities from a CAP LS reply that the server
+	// has split across multiple lines (each but the last marked with "*" in
+	// the third parameter), until we see the final line.
+	lsPending []string
+}
+
+func newSASLNegotiation(conf *Config) *saslNegotiation {
+	return &saslNegotiation{conf: conf}
+}
+
+func (s *saslNegotiation) wanted() bool {
+	return s.conf.SASLMechanism != ""
+}
+
+// handleCAP reacts to the CAP subcommands we care about (LS/ACK/NAK) while
+// negotiating capabilities. It ends capability negotiation itself (CAP END)
+// once there's nothing left for us to request.
+func (s *saslNegotiation) handleCAP(c *godrop.Client, m irc.Message) error {
+	if len(m.Params) < 2 {
+		return fmt.Errorf("malformed CAP message: %s", m)
+	}
+
+	subcommand := strings.ToUpper(m.Params[1])
+	caps := ""
+	if len(m.Params) > 2 {
+		caps = m.Params[len(m.Params)-1]
+	}
+
+	switch subcommand {
+	case "LS":
+		// A CAP LS 302 reply may be split across multiple lines, each marked
+		// with "*" in the third parameter except the last. Accumulate until
+		// we see the final line before acting on the full capability list.
+		more := len(m.Params) > 3 && m.Params[2] == "*"
+		s.lsPending = append(s.lsPending, strings.Fields(caps)...)
+		if more {
+			return nil
+		}
+
+		full := strings.Join(s.lsPending, " ")
+		s.lsPending = nil
+		return s.requestCaps(c, full)
+
+	case "ACK":
+		// sasl is always requested in its own CAP REQ (see requestCaps), so an
+		// ACK naming it is the reply to that request specifically, not to the
+		// optional capabilities batch.
+		if hasCapability(caps, "sasl") {
+			if err := c.Raw("AUTHENTICATE " + s.conf.SASLMechanism); err != nil {
+				return fmt.Errorf("error starting AUTHENTICATE: %s", err)
+			}
+			return nil
+		}
+
+		// This is the ack for the optional capabilities batch. If we're not
+		// also waiting on a separate reply for sasl, there's nothing left to
+		// negotiate.
+		if !s.wanted() {
+			return c.Raw("CAP END")
+		}
+		return nil
+
+	case "NAK":
+		// Likewise, a NAK naming sasl is specifically about our CAP REQ :sasl
+		// failing, since it's requested on its own line.
+		if hasCapability(caps, "sasl") {
+			return fmt.Errorf(
+				"server rejected the sasl capability; sasl-mechanism %s could not be negotiated",
+				s.conf.SASLMechanism)
+		}
+
+		// A NAK for the optional capabilities batch isn't fatal - it doesn't
+		// mean sasl failed, since that's negotiated separately.
+		if !s.wanted() {
+			return c.Raw("CAP END")
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// requestCaps requests the optional capabilities the server advertised that
+// we also want, and separately requests sasl if configured. These are sent
+// as two independent CAP REQ lines (rather than combined into one) because a
+// server NAKs and ACKs a CAP REQ as a whole and echoes back exactly the
+// capabilities it was asked for: if sasl shared a REQ with, say, chghost,
+// an older ircd lacking chghost would NAK the whole line and we'd have no
+// way to tell that from a genuine SASL failure. If sasl-mechanism is
+// configured but the server didn't advertise the sasl capability at all, we
+// fail outright rather than silently completing registration without
+// authenticating.
+func (s *saslNegotiation) requestCaps(c *godrop.Client, caps string) error {
+	if s.wanted() && !hasCapability(caps, "sasl") {
+		return fmt.Errorf(
+			"sasl-mechanism %s is configured but the server does not advertise the sasl capability",
+			s.conf.SASLMechanism)
+	}
+
+	var want []string
+	for _, capName := range ircv3Caps {
+		if hasCapability(caps, capName) {
+			want = append(want, capName)
+		}
+	}
+
+	if len(want) > 0 {
+		if err := c.Raw("CAP REQ :" + strings.Join(want, " ")); err != nil {
+			return fmt.Errorf("error requesting capabilities: %s", err)
+		}
+	}
+
+	if s.wanted() {
+		return c.Raw("CAP REQ :sasl")
+	}
+
+	if len(want) == 0 {
+		return c.Raw("CAP END")
+	}
+
+	return nil
+}
+
+// handleAuthenticate reacts to an AUTHENTICATE message from the server,
+// which is how it asks us for our SASL payload.
+func (s *saslNegotiation) handleAuthenticate(c *godrop.Client, m irc.Message) error {
+	switch s.conf.SASLMechanism {
+	case "EXTERNAL":
+		if err := c.Raw("AUTHENTICATE +"); err != nil {
+			return fmt.Errorf("error sending AUTHENTICATE: %s", err)
+		}
+		return nil
+
+	case "PLAIN":
+		return sendSASLPlain(c, s.conf.SASLUser, s.conf.SASLPass)
+	}
+
+	return fmt.Errorf("got AUTHENTICATE but no sasl-mechanism is configured")
+}
+
+// handleNumeric reacts to the SASL related numerics, ending capability
+// negotiation on success and failing the connection attempt on any of the
+// SASL error numerics.
+func (s *saslNegotiation) handleNumeric(c *godrop.Client, m irc.Message) error {
+	switch m.Command {
+	case rplSASLSuccess:
+		if err := c.Raw("CAP END"); err != nil {
+			return fmt.Errorf("error ending capability negotiation: %s", err)
+		}
+		return nil
+
+	case errSASLFail, errSASLTooLong, errSASLAborted, errSASLAlready:
+		return fmt.Errorf("SASL authentication failed: %s", m)
+	}
+
+	return nil
+}
+
+func isSASLNumeric(command string) bool {
+	switch command {
+	case rplSASLSuccess, errSASLFail, errSASLTooLong, errSASLAborted, errSASLAlready:
+		return true
+	}
+	return false
+}
+
+// saslPlainChunks base64 encodes a SASL PLAIN payload and splits it into
+// saslChunkSize byte pieces, one per AUTHENTICATE line. If the final chunk
+// is exactly saslChunkSize bytes it appends a trailing empty chunk, since an
+// empty AUTHENTICATE + is how we tell the server the payload is complete in
+// that case.
+func saslPlainChunks(user, pass string) []string {
+	payload := fmt.Sprintf("%s\x00%s\x00%s", user, user, pass)
+	encoded := base64.StdEncoding.EncodeToString([]byte(payload))
+
+	var chunks []string
+	for {
+		chunk := encoded
+		if len(chunk) > saslChunkSize {
+			chunk = chunk[:saslChunkSize]
+		}
+		encoded = encoded[len(chunk):]
+		chunks = append(chunks, chunk)
+
+		if len(encoded) == 0 {
+			if len(chunk) == saslChunkSize {
+				chunks = append(chunks, "")
+			}
+			return chunks
+		}
+	}
+}
+
+// sendSASLPlain sends a SASL PLAIN payload, base64 encoded and chunked at
+// saslChunkSize bytes per AUTHENTICATE line.
+func sendSASLPlain(c *godrop.Client, user, pass string) error {
+	for _, chunk := range saslPlainChunks(user, pass) {
+		if chunk == "" {
+			chunk = "+"
+		}
+		if err := c.Raw("AUTHENTICATE " + chunk); err != nil {
+			return fmt.Errorf("error sending AUTHENTICATE: %s", err)
+		}
+	}
+	return nil
+}
+
+// hasCapability reports whether name is present in a space separated CAP
+// capability list, ignoring the modifier prefixes (-, ~, =) servers may use
+// and any =value a capability carries (e.g. "sasl=PLAIN,EXTERNAL").
+func hasCapability(caps, name string) bool {
+	for _, c := range strings.Fields(caps) {
+		c = strings.TrimLeft(c, "-~=")
+		c = strings.SplitN(c, "=", 2)[0]
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
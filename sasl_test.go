@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestHasCapability(t *testing.T) {
+	tests := []struct {
+		caps string
+		name string
+		want bool
+	}{
+		{"multi-prefix sasl extended-join", "sasl", true},
+		{"multi-prefix sasl=PLAIN,EXTERNAL extended-join", "sasl", true},
+		{"multi-prefix sasl=PLAIN,EXTERNAL extended-join", "extended-join", true},
+		{"multi-prefix -sasl extended-join", "sasl", true},
+		{"multi-prefix ~sasl=PLAIN extended-join", "sasl", true},
+		{"multi-prefix extended-join", "sasl", false},
+		{"", "sasl", false},
+		{"SASL=PLAIN", "sasl", true},
+	}
+
+	for _, test := range tests {
+		if got := hasCapability(test.caps, test.name); got != test.want {
+			t.Errorf("hasCapability(%q, %q) = %v, wanted %v",
+				test.caps, test.name, got, test.want)
+		}
+	}
+}
+
+func TestSASLPlainChunks(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		pass string
+	}{
+		{"short payload fits in one chunk", "nick", "hunter2"},
+		{"payload encodes to exactly one chunk boundary", "a", strings.Repeat("x", 296)},
+		{"payload encodes to just over one chunk boundary", "a", strings.Repeat("x", 297)},
+		{"payload spans several chunks", "nick", strings.Repeat("x", 1000)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			chunks := saslPlainChunks(test.user, test.pass)
+			if len(chunks) == 0 {
+				t.Fatalf("saslPlainChunks(%q, %q) returned no chunks", test.user, test.pass)
+			}
+
+			payload := test.user + "\x00" + test.user + "\x00" + test.pass
+			wantEncoded := base64.StdEncoding.EncodeToString([]byte(payload))
+
+			last := chunks[len(chunks)-1]
+			if last == "" {
+				// A trailing empty chunk is only valid when the chunk before it
+				// was exactly a full saslChunkSize.
+				if len(chunks) < 2 || len(chunks[len(chunks)-2]) != saslChunkSize {
+					t.Fatalf("saslPlainChunks(%q, %q) = %v, trailing empty chunk without a preceding full chunk",
+						test.user, test.pass, chunks)
+				}
+				chunks = chunks[:len(chunks)-1]
+			}
+
+			var gotEncoded strings.Builder
+			for _, chunk := range chunks {
+				if len(chunk) > saslChunkSize {
+					t.Fatalf("saslPlainChunks(%q, %q) produced a chunk of %d bytes, wanted <= %d",
+						test.user, test.pass, len(chunk), saslChunkSize)
+				}
+				gotEncoded.WriteString(chunk)
+			}
+
+			if gotEncoded.String() != wantEncoded {
+				t.Errorf("saslPlainChunks(%q, %q) reassembled to %q, wanted %q",
+					test.user, test.pass, gotEncoded.String(), wantEncoded)
+			}
+		})
+	}
+}
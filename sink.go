@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log message passed to a Sink.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "DEBUG"
+	case levelInfo:
+		return "INFO"
+	case levelWarn:
+		return "WARN"
+	case levelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// Sink is a destination for our log output. console, rotating file, syslog,
+// and the IRC channel report path are all implementations of it.
+type Sink interface {
+	Log(level logLevel, ts time.Time, msg string)
+	Close() error
+}
+
+// buildSink constructs the sink selected by conf.SinkType.
+func buildSink(conf *Config) (Sink, error) {
+	switch conf.SinkType {
+	case "", "console":
+		return consoleSink{}, nil
+	case "file":
+		return newFileSink(conf)
+	case "syslog":
+		return newSyslogSink(conf)
+	}
+	return nil, fmt.Errorf("unsupported sink-type: %s", conf.SinkType)
+}
+
+// consoleSink writes to stderr via the standard logger.
+type consoleSink struct{}
+
+func (consoleSink) Log(level logLevel, ts time.Time, msg string) {
+	log.Printf("%s [%s] %s", ts.Format(time.RFC3339), level, msg)
+}
+
+func (consoleSink) Close() error { return nil }
+
+// ircSink accumulates messages to report into our IRC channels. It's always
+// active regardless of sink-type since channel reporting is our original
+// (and lowest effort) way to surface problems to an operator watching the
+// channel.
+type ircSink struct {
+	mu      sync.Mutex
+	pending []string
+}
+
+func newIRCSink() *ircSink {
+	return &ircSink{}
+}
+
+func (s *ircSink) Log(level logLevel, ts time.Time, msg string) {
+	if level < levelWarn {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, fmt.Sprintf("%s: %s", ts.Format(time.RFC3339), msg))
+}
+
+func (s *ircSink) Close() error { return nil }
+
+// drain returns and clears the messages waiting to be reported.
+func (s *ircSink) drain() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+// requeue puts messages we failed to report back at the front of the
+// queue.
+func (s *ircSink) requeue(remaining []string) {
+	if len(remaining) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(remaining, s.pending...)
+}
+
+// fileSink is a rotating filesystem sink.
+type fileSink struct {
+	mu sync.Mutex
+
+	path        string
+	maxSizeByte int64
+	maxBackups  int
+	maxAge      time.Duration
+
+	f    *os.File
+	size int64
+}
+
+func newFileSink(conf *Config) (*fileSink, error) {
+	f, err := os.OpenFile(conf.SinkFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sink-file-path: %s: %s",
+			conf.SinkFilePath, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error statting sink-file-path: %s: %s",
+			conf.SinkFilePath, err)
+	}
+
+	return &fileSink{
+		path:        conf.SinkFilePath,
+		maxSizeByte: int64(conf.SinkMaxSizeMB) * 1024 * 1024,
+		maxBackups:  conf.SinkMaxBackups,
+		maxAge:      time.Duration(conf.SinkMaxAgeDays) * 24 * time.Hour,
+		f:           f,
+		size:        info.Size(),
+	}, nil
+}
+
+func (s *fileSink) Log(level logLevel, ts time.Time, msg string) {
+	line := fmt.Sprintf("%s [%s] %s\n", ts.Format(time.RFC3339), level, msg)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSizeByte > 0 && s.size+int64(len(line)) > s.maxSizeByte {
+		if err := s.rotate(); err != nil {
+			log.Printf("error rotating %s: %s", s.path, err)
+		}
+	}
+
+	n, err := s.f.WriteString(line)
+	if err != nil {
+		log.Printf("error writing to %s: %s", s.path, err)
+		return
+	}
+	s.size += int64(n)
+}
+
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	backup := fmt.Sprintf("%s.%s", s.path, time.Now().Format("20060102T150405"))
+	if err := os.Rename(s.path, backup); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size = 0
+
+	go s.pruneBackups()
+
+	return nil
+}
+
+// pruneBackups removes rotated files beyond maxBackups or older than
+// maxAge. It runs in its own goroutine since it touches the filesystem and
+// shouldn't hold up logging.
+func (s *fileSink) pruneBackups() {
+	dir := filepath.Dir(s.path)
+	base := filepath.Base(s.path)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("error listing %s to prune old logs: %s", dir, err)
+		return
+	}
+
+	var backups []os.FileInfo
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), base+".") {
+			backups = append(backups, e)
+		}
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ModTime().After(backups[j].ModTime())
+	})
+
+	for i, b := range backups {
+		tooOld := s.maxAge > 0 && time.Since(b.ModTime()) > s.maxAge
+		tooMany := s.maxBackups > 0 && i >= s.maxBackups
+		if tooOld || tooMany {
+			if err := os.Remove(filepath.Join(dir, b.Name())); err != nil {
+				log.Printf("error removing old log %s: %s", b.Name(), err)
+			}
+		}
+	}
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
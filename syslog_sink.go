@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"os"
+	"time"
+)
+
+// syslogSink writes to the local syslog/journald, or to a remote syslog
+// collector over UDP/TCP using RFC 5424 framing.
+type syslogSink struct {
+	local *syslog.Writer
+	conn  net.Conn
+}
+
+func newSyslogSink(conf *Config) (*syslogSink, error) {
+	if conf.SinkSyslogAddress == "" {
+		w, err := syslog.New(syslog.LOG_DAEMON, "umbled")
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to local syslog: %s", err)
+		}
+		return &syslogSink{local: w}, nil
+	}
+
+	conn, err := net.Dial(conf.SinkSyslogNetwork, conf.SinkSyslogAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing syslog %s %s: %s",
+			conf.SinkSyslogNetwork, conf.SinkSyslogAddress, err)
+	}
+	return &syslogSink{conn: conn}, nil
+}
+
+func (s *syslogSink) Log(level logLevel, ts time.Time, msg string) {
+	if s.local != nil {
+		switch level {
+		case levelDebug:
+			_ = s.local.Debug(msg)
+		case levelInfo:
+			_ = s.local.Info(msg)
+		case levelWarn:
+			_ = s.local.Warning(msg)
+		default:
+			_ = s.local.Err(msg)
+		}
+		return
+	}
+
+	if _, err := s.conn.Write([]byte(formatRFC5424(level, ts, msg))); err != nil {
+		log.Printf("error writing to remote syslog: %s", err)
+	}
+}
+
+func (s *syslogSink) Close() error {
+	if s.local != nil {
+		return s.local.Close()
+	}
+	return s.conn.Close()
+}
+
+// formatRFC5424 renders msg as an RFC 5424 syslog message.
+func formatRFC5424(level logLevel, ts time.Time, msg string) string {
+	const facility = 3 // daemon
+
+	var severity int
+	switch level {
+	case levelDebug:
+		severity = 7
+	case levelInfo:
+		severity = 6
+	case levelWarn:
+		severity = 4
+	default:
+		severity = 3
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s umbled - - - %s\n",
+		facility*8+severity, ts.Format(time.RFC3339), hostname, msg)
+}
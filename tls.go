@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// buildTLSConfig turns our TLS related config keys into a *tls.Config we can
+// hand to the client.
+func buildTLSConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerHost,
+		InsecureSkipVerify: conf.TLSSkipVerify,
+	}
+
+	if conf.TLSCAFile != "" {
+		buf, err := ioutil.ReadFile(conf.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tls-ca-file: %s: %s",
+				conf.TLSCAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("error parsing tls-ca-file: %s", conf.TLSCAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.TLSClientCert != "" || conf.TLSClientKey != "" {
+		if conf.TLSClientCert == "" || conf.TLSClientKey == "" {
+			return nil, fmt.Errorf(
+				"tls-client-cert and tls-client-key must both be set")
+		}
+
+		cert, err := tls.LoadX509KeyPair(conf.TLSClientCert, conf.TLSClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client cert/key: %s", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
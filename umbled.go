@@ -7,15 +7,9 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"strconv"
-	"strings"
 	"time"
 
 	"github.com/horgh/godrop"
@@ -29,16 +23,12 @@ func main() {
 		return
 	}
 
-	conf, err := parseConfig(args.Config)
+	configs, err := parseConfig(args.Config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	client := godrop.New(conf.Nick, conf.Nick, conf.Nick, conf.ServerHost,
-		conf.ServerPort, true)
-	client.SetTimeoutTime(7 * time.Minute)
-
-	run(conf, client)
+	superviseNetworks(args.Config, configs)
 }
 
 // Args hold command line arguments.
@@ -61,175 +51,151 @@ func getArgs() (*Args, error) {
 	}, nil
 }
 
-// Config holds what we parsed from a config file.
-type Config struct {
-	Channels   []string
-	Nick       string
-	ServerHost string
-	ServerPort int
-}
+type state struct {
+	lastActivityTime time.Time
 
-func parseConfig(path string) (*Config, error) {
-	buf, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, fmt.Errorf("error reading file: %s: %s", path, err)
-	}
+	// connectedAt is when the current connection was established. We use it
+	// to decide whether the connection has been stable long enough to reset
+	// our backoff attempt counter.
+	connectedAt time.Time
 
-	reader := bytes.NewReader(buf)
-	scanner := bufio.NewScanner(reader)
+	// attempt is how many consecutive reconnect attempts we've made since
+	// our last stable connection. It drives the exponential backoff delay.
+	attempt int
 
-	m := map[string]string{}
+	// nextRetryAt is when we're allowed to try to connect again.
+	nextRetryAt time.Time
 
-	for scanner.Scan() {
-		text := scanner.Text()
-		text = strings.TrimSpace(text)
-		if text == "" || text[0] == '#' {
-			continue
-		}
+	// connectionsThisHour and hourWindowStart implement our per-hour
+	// connection-attempt budget.
+	connectionsThisHour int
+	hourWindowStart     time.Time
 
-		pieces := strings.SplitN(text, "=", 2)
-		if len(pieces) != 2 {
-			return nil, fmt.Errorf("malformed line: %s", text)
-		}
+	// irc is the sink that accumulates messages to report into the IRC
+	// channels we're in. It's always active alongside whatever sink-type is
+	// configured.
+	irc *ircSink
 
-		key := strings.TrimSpace(pieces[0])
-		value := strings.TrimSpace(pieces[1])
+	// sinks receive every log message we produce.
+	sinks []Sink
 
-		if key == "" {
-			return nil, fmt.Errorf("key is blank: %s", text)
-		}
+	// handlers dispatches incoming messages to whatever is registered for
+	// their command.
+	handlers *HandlerSet
 
-		// Allow value to be blank
+	// nick is the nick we're currently using, which may have diverged from
+	// conf.Nick if we hit a collision and had to pick another one.
+	nick string
 
-		if _, ok := m[key]; ok {
-			return nil, fmt.Errorf("duplicate key: %s", key)
-		}
+	// lastPingSentAt is when we last sent our own idle probe PING.
+	lastPingSentAt time.Time
 
-		m[key] = value
-	}
+	// away tracks whether we've marked ourselves away due to prolonged
+	// silence on the link.
+	away bool
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error scanning file: %s: %s", path, err)
+// newState builds a state with its sinks and handlers wired up per conf. If
+// conf has a report-network configured, bus must be non-nil so we can wire
+// up a busSink to carry our errors over to it.
+func newState(conf *Config, bus *crossNetworkBus) (*state, error) {
+	sink, err := buildSink(conf)
+	if err != nil {
+		return nil, fmt.Errorf("error building sink: %s", err)
 	}
 
-	conf := &Config{}
-
-	channelsRaw := strings.Split(m["channels"], ",")
-	for _, c := range channelsRaw {
-		c = strings.TrimSpace(c)
-		if c == "" {
-			continue
-		}
-		if c[0] != '#' {
-			return nil, fmt.Errorf("malformed channel name: %s", c)
-		}
-		// We could look for dupes.
-		conf.Channels = append(conf.Channels, c)
-	}
-	if len(conf.Channels) == 0 {
-		return nil, fmt.Errorf("you must specify at least one channel")
-	}
+	irc := newIRCSink()
 
-	if v := m["nick"]; v == "" {
-		return nil, fmt.Errorf("you must specify a nick")
-	}
-	conf.Nick = m["nick"]
+	hs := newHandlerSet()
+	registerBuiltinHandlers(hs, conf)
 
-	if v := m["server-host"]; v == "" {
-		return nil, fmt.Errorf("you must specify a server-host")
+	sinks := []Sink{irc, sink}
+	if conf.ReportNetwork != "" {
+		sinks = append(sinks, &busSink{
+			bus:     bus,
+			network: conf.ReportNetwork,
+			channel: conf.ReportChannel,
+		})
 	}
-	conf.ServerHost = m["server-host"]
 
-	p, err := strconv.ParseInt(m["server-port"], 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("invalid server-port: %s", err)
-	}
-	conf.ServerPort = int(p)
-
-	return conf, nil
-}
-
-type state struct {
-	lastActivityTime time.Time
-	errors           []string
+	return &state{
+		hourWindowStart: time.Now(),
+		irc:             irc,
+		sinks:           sinks,
+		handlers:        hs,
+	}, nil
 }
 
 const (
 	waitPeriod = 15 * time.Minute
+
+	backoffBase = 2 * time.Second
+	backoffCap  = 5 * time.Minute
+
+	// stableAfter is how long a connection must stay up before we consider
+	// it stable and reset the backoff attempt counter.
+	stableAfter = 60 * time.Second
+
+	defaultMaxConnectionsPerHour = 30
+
+	// defaultPingInterval is how long we let the link sit idle before we
+	// probe it ourselves rather than waiting on the server to PING us.
+	defaultPingInterval = 3 * time.Minute
+
+	// awayAfter is how many ping-intervals of silence we let pass before we
+	// mark ourselves away.
+	awayAfter = 3
 )
 
-func run(conf *Config, c *godrop.Client) {
-	s := &state{}
+func connect(conf *Config, c *godrop.Client, s *state) error {
+	s.nick = conf.Nick
 
-	for {
-		time.Sleep(time.Second)
+	if err := c.Connect(); err != nil {
+		return err
+	}
 
-		if !c.IsConnected() {
-			if err := connect(conf, c); err != nil {
-				s.addError("error connecting: %s", err)
-				_ = c.Close()
-				continue
-			}
-			s.lastActivityTime = time.Now()
-			continue
-		}
+	if err := c.Raw("CAP LS 302"); err != nil {
+		return fmt.Errorf("error sending CAP LS: %s", err)
+	}
+
+	if err := c.Register(); err != nil {
+		return err
+	}
 
+	sasl := newSASLNegotiation(conf)
+
+	for {
 		m, err := c.ReadMessage()
 		if err != nil {
-			s.addError("error reading: %s", err)
-			// If we hit EOF then we'll see it from now on, so give up.
-			if s.shouldGiveUp() || err == io.EOF {
-				_ = c.Close()
-			}
-			continue
+			return err
 		}
 
-		s.lastActivityTime = time.Now()
+		s.lastActivityTime = messageTime(m)
 
 		if m.Command == "ERROR" {
-			s.addError("got ERROR: %s", m)
-			_ = c.Close()
-			continue
+			return fmt.Errorf("received ERROR: %s", m)
 		}
 
-		if m.Command != "PING" {
+		if m.Command == "CAP" {
+			if err := sasl.handleCAP(c, m); err != nil {
+				return err
+			}
 			continue
 		}
 
-		if err := c.Pong(m); err != nil {
-			s.addError("error PONGing: %s", err)
-			if s.shouldGiveUp() {
-				_ = c.Close()
+		if m.Command == "AUTHENTICATE" {
+			if err := sasl.handleAuthenticate(c, m); err != nil {
+				return err
 			}
 			continue
 		}
 
-		s.lastActivityTime = time.Now()
-
-		if err := sendMessages(conf, c, s); err != nil {
-			s.addError("error messaging: %s", err)
-			if s.shouldGiveUp() {
-				_ = c.Close()
+		if isSASLNumeric(m.Command) {
+			if err := sasl.handleNumeric(c, m); err != nil {
+				return err
 			}
 			continue
 		}
-	}
-}
-
-func connect(conf *Config, c *godrop.Client) error {
-	if err := c.Connect(); err != nil {
-		return err
-	}
-
-	if err := c.Register(); err != nil {
-		return err
-	}
-
-	for {
-		m, err := c.ReadMessage()
-		if err != nil {
-			return err
-		}
 
 		if m.Command == irc.ReplyWelcome {
 			c.SetRegistered()
@@ -243,22 +209,26 @@ func connect(conf *Config, c *godrop.Client) error {
 			return nil
 		}
 
-		if m.Command == "ERROR" {
-			return fmt.Errorf("received ERROR: %s", m)
+		for _, handlerErr := range s.handlers.Dispatch(c, s, m) {
+			s.addError("error handling %s: %s", m.Command, handlerErr)
 		}
 	}
 }
 
 func (s *state) addError(format string, args ...interface{}) {
-	finalArgs := []interface{}{time.Now().Format(time.RFC3339)}
-	if len(args) > 0 {
-		finalArgs = append(finalArgs, args...)
-	}
+	s.logf(levelError, format, args...)
+}
 
-	m := fmt.Sprintf("%s: "+format, finalArgs...)
-	log.Print(m)
+// logf formats a message and sends it to every sink at the given level.
+func (s *state) logf(level logLevel, format string, args ...interface{}) {
+	s.log(level, fmt.Sprintf(format, args...))
+}
 
-	s.errors = append(s.errors, m)
+func (s *state) log(level logLevel, msg string) {
+	ts := time.Now()
+	for _, sink := range s.sinks {
+		sink.Log(level, ts, msg)
+	}
 }
 
 func (s *state) shouldGiveUp() bool {
@@ -266,10 +236,12 @@ func (s *state) shouldGiveUp() bool {
 }
 
 func sendMessages(conf *Config, c *godrop.Client, s *state) error {
+	pending := s.irc.drain()
+
 	for _, ch := range conf.Channels {
-		for i, e := range s.errors {
+		for i, e := range pending {
 			if err := c.Message(ch, e); err != nil {
-				s.errors = s.errors[i:]
+				s.irc.requeue(pending[i:])
 				return err
 			}
 
@@ -277,6 +249,5 @@ func sendMessages(conf *Config, c *godrop.Client, s *state) error {
 		}
 	}
 
-	s.errors = nil
 	return nil
 }
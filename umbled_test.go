@@ -25,17 +25,19 @@ func TestAddError(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		s := &state{}
+		irc := newIRCSink()
+		s := &state{irc: irc, sinks: []Sink{irc}}
 		s.addError(test.Format, test.Args...)
 
-		if len(s.errors) != 1 {
-			t.Errorf("len(s.errors) = %d, wanted %d", len(s.errors), 1)
+		pending := irc.drain()
+		if len(pending) != 1 {
+			t.Errorf("len(pending) = %d, wanted %d", len(pending), 1)
 			continue
 		}
 
-		if !test.Output.MatchString(s.errors[0]) {
+		if !test.Output.MatchString(pending[0]) {
 			t.Errorf("addError(%s, %v) = %s, wanted %s", test.Format, test.Args,
-				s.errors[0], test.Output)
+				pending[0], test.Output)
 		}
 	}
 }